@@ -0,0 +1,161 @@
+// Copyright 2012-2013 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Field is a single piece of structured context attached to a log line,
+// e.g. F("cid", c.cid).
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// F is shorthand for constructing a Field.
+func F(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+// Logger is the interface every subsystem logs through. The default
+// implementation (newLeveledLogger) writes level-filtered, optionally
+// JSON-encoded lines to stderr or a rotating file; it can be swapped out
+// via Options.Logger for another implementation (e.g. one backed by a
+// third-party structured logging library) without touching call sites.
+type Logger interface {
+	Debug(args ...interface{})
+	Debugf(format string, args ...interface{})
+	Info(args ...interface{})
+	Infof(format string, args ...interface{})
+	Warn(args ...interface{})
+	Warnf(format string, args ...interface{})
+	Error(args ...interface{})
+	Errorf(format string, args ...interface{})
+	Fatalf(format string, args ...interface{})
+	// With returns a child Logger that includes fields on every line it
+	// writes in addition to this logger's own fields.
+	With(fields ...Field) Logger
+}
+
+// LogLevel filters which calls to the Logger actually produce output.
+type LogLevel int
+
+const (
+	LogLevelDebug LogLevel = iota
+	LogLevelInfo
+	LogLevelWarn
+	LogLevelError
+)
+
+func parseLogLevel(s string) LogLevel {
+	switch s {
+	case "debug":
+		return LogLevelDebug
+	case "warn":
+		return LogLevelWarn
+	case "error":
+		return LogLevelError
+	default:
+		return LogLevelInfo
+	}
+}
+
+// leveledLogger is the default Logger implementation.
+type leveledLogger struct {
+	mu     *sync.Mutex
+	out    *rotatingWriter
+	level  LogLevel
+	json   bool
+	fields []Field
+}
+
+// newLeveledLogger builds the server's default logger from Options.
+func newLeveledLogger(opts *Options) (*leveledLogger, error) {
+	w, err := newRotatingWriter(opts.LogFile)
+	if err != nil {
+		return nil, err
+	}
+	return &leveledLogger{
+		mu:    &sync.Mutex{},
+		out:   w,
+		level: parseLogLevel(opts.LogLevel),
+		json:  opts.LogJSON,
+	}, nil
+}
+
+func (l *leveledLogger) With(fields ...Field) Logger {
+	nl := &leveledLogger{mu: l.mu, out: l.out, level: l.level, json: l.json}
+	nl.fields = append(append([]Field{}, l.fields...), fields...)
+	return nl
+}
+
+func (l *leveledLogger) log(level LogLevel, levelName, msg string) {
+	if level < l.level {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.json {
+		entry := map[string]interface{}{
+			"ts":    time.Now().UTC().Format(time.RFC3339Nano),
+			"level": levelName,
+			"msg":   msg,
+		}
+		for _, f := range l.fields {
+			entry[f.Key] = f.Value
+		}
+		b, err := json.Marshal(entry)
+		if err != nil {
+			return
+		}
+		l.out.Write(append(b, '\n'))
+		return
+	}
+	line := fmt.Sprintf("[%s] %s %s", levelName, time.Now().Format("2006/01/02 15:04:05"), msg)
+	for _, f := range l.fields {
+		line += fmt.Sprintf(" %s=%v", f.Key, f.Value)
+	}
+	l.out.Write([]byte(line + "\n"))
+}
+
+func (l *leveledLogger) Debug(args ...interface{}) { l.log(LogLevelDebug, "DBG", fmt.Sprint(args...)) }
+func (l *leveledLogger) Debugf(format string, args ...interface{}) { l.log(LogLevelDebug, "DBG", fmt.Sprintf(format, args...)) }
+func (l *leveledLogger) Info(args ...interface{}) { l.log(LogLevelInfo, "INF", fmt.Sprint(args...)) }
+func (l *leveledLogger) Infof(format string, args ...interface{}) { l.log(LogLevelInfo, "INF", fmt.Sprintf(format, args...)) }
+func (l *leveledLogger) Warn(args ...interface{}) { l.log(LogLevelWarn, "WRN", fmt.Sprint(args...)) }
+func (l *leveledLogger) Warnf(format string, args ...interface{}) { l.log(LogLevelWarn, "WRN", fmt.Sprintf(format, args...)) }
+func (l *leveledLogger) Error(args ...interface{}) { l.log(LogLevelError, "ERR", fmt.Sprint(args...)) }
+func (l *leveledLogger) Errorf(format string, args ...interface{}) { l.log(LogLevelError, "ERR", fmt.Sprintf(format, args...)) }
+
+func (l *leveledLogger) Fatalf(format string, args ...interface{}) {
+	l.log(LogLevelError, "FTL", fmt.Sprintf(format, args...))
+	os.Exit(1)
+}
+
+// reopen is called on SIGUSR1 so operators can rotate the log file out
+// from under us (e.g. via logrotate) and have us start writing to the
+// newly created file.
+func (l *leveledLogger) reopen() error {
+	return l.out.reopen()
+}
+
+// LogInit builds s.log from Options, replacing the package-level
+// Log/Logf/Debug/Debugf/Fatalf helpers used by earlier versions of the
+// server with structured, level-filtered logging.
+func (s *Server) LogInit() {
+	if s.opts.Logger != nil {
+		s.log = s.opts.Logger.With(F("server_id", s.info.Id))
+		return
+	}
+	log, err := newLeveledLogger(s.opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error initializing logger: %v\n", err)
+		os.Exit(1)
+	}
+	s.log = log.With(F("server_id", s.info.Id))
+}
@@ -0,0 +1,89 @@
+// Copyright 2012-2013 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"os"
+	"sync"
+)
+
+// maxLogFileSize is the default size threshold, in bytes, at which a log
+// file is rotated aside before we keep writing to a fresh one.
+const maxLogFileSize = 100 * 1024 * 1024 // 100MB
+
+// rotatingWriter writes to Options.LogFile (or stderr if unset),
+// rolling the file aside once it crosses maxLogFileSize and reopening it
+// from scratch when reopen() is called, e.g. in response to SIGUSR1 so
+// that external tools like logrotate can manage retention.
+type rotatingWriter struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+	size int64
+}
+
+func newRotatingWriter(path string) (*rotatingWriter, error) {
+	w := &rotatingWriter{path: path}
+	if path == "" {
+		w.file = os.Stderr
+		return w, nil
+	}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *rotatingWriter) open() error {
+	f, err := os.OpenFile(w.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.file = f
+	w.size = fi.Size()
+	return nil
+}
+
+func (w *rotatingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.path != "" && w.size+int64(len(p)) > maxLogFileSize {
+		w.rotateLocked()
+	}
+
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// rotateLocked renames the current log file aside with a timestamp-free
+// ".old" suffix and opens a fresh one in its place. Callers must hold w.mu.
+func (w *rotatingWriter) rotateLocked() {
+	w.file.Close()
+	os.Rename(w.path, w.path+".old")
+	if f, err := os.OpenFile(w.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644); err == nil {
+		w.file = f
+		w.size = 0
+	}
+}
+
+// reopen closes and reopens the underlying file without rotating it,
+// so it picks up a file that logrotate (or similar) has already moved
+// out from under us.
+func (w *rotatingWriter) reopen() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.path == "" {
+		return nil
+	}
+	if w.file != nil {
+		w.file.Close()
+	}
+	return w.open()
+}
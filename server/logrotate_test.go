@@ -0,0 +1,80 @@
+// Copyright 2012-2013 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRotatingWriterRotatesAtSizeThreshold(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.log")
+
+	w, err := newRotatingWriter(path)
+	if err != nil {
+		t.Fatalf("newRotatingWriter: %v", err)
+	}
+
+	w.size = maxLogFileSize - 2
+	if _, err := w.Write([]byte("xx")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if _, err := w.Write([]byte("rotated")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	if _, err := os.Stat(path + ".old"); err != nil {
+		t.Fatalf("expected rotated file %s.old: %v", path, err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading current log: %v", err)
+	}
+	if string(data) != "rotated" {
+		t.Fatalf("current log = %q, want %q", data, "rotated")
+	}
+}
+
+func TestRotatingWriterReopenPicksUpMovedFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.log")
+
+	w, err := newRotatingWriter(path)
+	if err != nil {
+		t.Fatalf("newRotatingWriter: %v", err)
+	}
+	if _, err := w.Write([]byte("before")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	if err := os.Rename(path, path+".moved"); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+
+	if err := w.reopen(); err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if _, err := w.Write([]byte("after")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading reopened log: %v", err)
+	}
+	if string(data) != "after" {
+		t.Fatalf("reopened log = %q, want %q", data, "after")
+	}
+}
+
+func TestRotatingWriterReopenNoopForStderr(t *testing.T) {
+	w, err := newRotatingWriter("")
+	if err != nil {
+		t.Fatalf("newRotatingWriter: %v", err)
+	}
+	if err := w.reopen(); err != nil {
+		t.Fatalf("reopen on stderr-backed writer should be a no-op, got: %v", err)
+	}
+}
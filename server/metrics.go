@@ -0,0 +1,176 @@
+// Copyright 2012-2013 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// metrics holds the extra counters/histograms exposed on /metrics, on
+// top of the plain atomics already tracked by stats.
+type metrics struct {
+	connsTotal        int64
+	slowConsumers     int64
+	authFailures      int64
+	msgSizeHist       histogram
+	processingLatency histogram
+}
+
+// histogram is a minimal fixed-bucket Prometheus-style histogram.
+type histogram struct {
+	mu      sync.Mutex
+	buckets []float64 // upper bounds, ascending, not including +Inf
+	counts  []uint64  // len(buckets)+1, last is the +Inf bucket
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets)+1)}
+}
+
+func (h *histogram) observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.sum += v
+	h.count++
+	i := sort.SearchFloat64s(h.buckets, v)
+	h.counts[i]++
+}
+
+// cumulativeCounts returns, per bucket boundary plus +Inf, the running
+// total of observations <= that boundary.
+func (h *histogram) cumulativeCounts() []uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	out := make([]uint64, len(h.counts))
+	var running uint64
+	for i, c := range h.counts {
+		running += c
+		out[i] = running
+	}
+	return out
+}
+
+var defaultSizeBuckets = []float64{64, 256, 1024, 4096, 16384, 65536, 262144}
+var defaultLatencyBuckets = []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1}
+
+// DefaultMetricsPath is used when Options.MetricsPath is unset.
+const DefaultMetricsPath = "/metrics"
+
+// newMetrics builds the histograms backing /metrics.
+func newMetrics() *metrics {
+	return &metrics{
+		msgSizeHist:       *newHistogram(defaultSizeBuckets),
+		processingLatency: *newHistogram(defaultLatencyBuckets),
+	}
+}
+
+// RegisterMetrics wires the /metrics handler into the HTTP monitor.
+func (s *Server) RegisterMetrics() {
+	path := s.opts.MetricsPath
+	if path == "" {
+		path = DefaultMetricsPath
+	}
+	http.HandleFunc(path, s.basicAuthWrap(s.HandleMetrics))
+}
+
+// basicAuthWrap enforces Options.MetricsUser/MetricsPassword, if set.
+func (s *Server) basicAuthWrap(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.opts.MetricsUser != "" {
+			user, pass, ok := r.BasicAuth()
+			userOk := subtle.ConstantTimeCompare([]byte(user), []byte(s.opts.MetricsUser)) == 1
+			passOk := subtle.ConstantTimeCompare([]byte(pass), []byte(s.opts.MetricsPassword)) == 1
+			if !ok || !userOk || !passOk {
+				w.Header().Set("WWW-Authenticate", `Basic realm="metrics"`)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		h(w, r)
+	}
+}
+
+// HandleMetrics renders this server's counters, gauges and histograms
+// in Prometheus text exposition format.
+func (s *Server) HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	numClients := len(s.clients)
+	numRoutes := len(s.routes)
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprintf(w, "# HELP nats_in_msgs_total Total messages received.\n")
+	fmt.Fprintf(w, "# TYPE nats_in_msgs_total counter\n")
+	fmt.Fprintf(w, "nats_in_msgs_total %d\n", atomic.LoadInt64(&s.inMsgs))
+
+	fmt.Fprintf(w, "# HELP nats_out_msgs_total Total messages sent.\n")
+	fmt.Fprintf(w, "# TYPE nats_out_msgs_total counter\n")
+	fmt.Fprintf(w, "nats_out_msgs_total %d\n", atomic.LoadInt64(&s.outMsgs))
+
+	fmt.Fprintf(w, "# HELP nats_in_bytes_total Total bytes received.\n")
+	fmt.Fprintf(w, "# TYPE nats_in_bytes_total counter\n")
+	fmt.Fprintf(w, "nats_in_bytes_total %d\n", atomic.LoadInt64(&s.inBytes))
+
+	fmt.Fprintf(w, "# HELP nats_out_bytes_total Total bytes sent.\n")
+	fmt.Fprintf(w, "# TYPE nats_out_bytes_total counter\n")
+	fmt.Fprintf(w, "nats_out_bytes_total %d\n", atomic.LoadInt64(&s.outBytes))
+
+	fmt.Fprintf(w, "# HELP nats_connections_total Total connections accepted.\n")
+	fmt.Fprintf(w, "# TYPE nats_connections_total counter\n")
+	fmt.Fprintf(w, "nats_connections_total %d\n", atomic.LoadInt64(&s.metrics.connsTotal))
+
+	fmt.Fprintf(w, "# HELP nats_slow_consumers_total Total clients disconnected for being slow consumers.\n")
+	fmt.Fprintf(w, "# TYPE nats_slow_consumers_total counter\n")
+	fmt.Fprintf(w, "nats_slow_consumers_total %d\n", atomic.LoadInt64(&s.metrics.slowConsumers))
+
+	fmt.Fprintf(w, "# HELP nats_auth_failures_total Total failed authentication attempts.\n")
+	fmt.Fprintf(w, "# TYPE nats_auth_failures_total counter\n")
+	fmt.Fprintf(w, "nats_auth_failures_total %d\n", atomic.LoadInt64(&s.metrics.authFailures))
+
+	fmt.Fprintf(w, "# HELP nats_clients Current connected clients.\n")
+	fmt.Fprintf(w, "# TYPE nats_clients gauge\n")
+	fmt.Fprintf(w, "nats_clients %d\n", numClients)
+
+	fmt.Fprintf(w, "# HELP nats_subscriptions Current active subscriptions.\n")
+	fmt.Fprintf(w, "# TYPE nats_subscriptions gauge\n")
+	fmt.Fprintf(w, "nats_subscriptions %d\n", s.sl.Count())
+
+	fmt.Fprintf(w, "# HELP nats_routes Current active routes.\n")
+	fmt.Fprintf(w, "# TYPE nats_routes gauge\n")
+	fmt.Fprintf(w, "nats_routes %d\n", numRoutes)
+
+	fmt.Fprintf(w, "# HELP nats_goroutines Current number of goroutines.\n")
+	fmt.Fprintf(w, "# TYPE nats_goroutines gauge\n")
+	fmt.Fprintf(w, "nats_goroutines %d\n", runtime.NumGoroutine())
+
+	writeHistogram(w, "nats_msg_size_bytes", "Size of processed messages, in bytes.", defaultSizeBuckets, &s.metrics.msgSizeHist)
+	writeHistogram(w, "nats_msg_processing_seconds", "Time spent processing a single message in readLoop.", defaultLatencyBuckets, &s.metrics.processingLatency)
+}
+
+func writeHistogram(w http.ResponseWriter, name, help string, buckets []float64, h *histogram) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+	counts := h.cumulativeCounts()
+	for i, le := range buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, le, counts[i])
+	}
+	sum, count := h.sumAndCount()
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, counts[len(counts)-1])
+	fmt.Fprintf(w, "%s_sum %g\n", name, sum)
+	fmt.Fprintf(w, "%s_count %d\n", name, count)
+}
+
+func (h *histogram) sumAndCount() (float64, uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.sum, h.count
+}
@@ -0,0 +1,42 @@
+// Copyright 2012-2013 Apcera Inc. All rights reserved.
+
+package server
+
+import "testing"
+
+func TestHistogramObserveAndCumulativeCounts(t *testing.T) {
+	h := newHistogram([]float64{1, 5, 10})
+
+	for _, v := range []float64{0.5, 1, 3, 7, 20} {
+		h.observe(v)
+	}
+
+	counts := h.cumulativeCounts()
+	want := []uint64{2, 3, 4, 5} // <=1, <=5, <=10, +Inf
+	if len(counts) != len(want) {
+		t.Fatalf("cumulativeCounts() = %v, want len %d", counts, len(want))
+	}
+	for i, c := range counts {
+		if c != want[i] {
+			t.Errorf("cumulativeCounts()[%d] = %d, want %d", i, c, want[i])
+		}
+	}
+
+	sum, count := h.sumAndCount()
+	if count != 5 {
+		t.Errorf("count = %d, want 5", count)
+	}
+	if sum != 31.5 {
+		t.Errorf("sum = %v, want 31.5", sum)
+	}
+}
+
+func TestHistogramBucketBoundaryIsInclusive(t *testing.T) {
+	h := newHistogram([]float64{5})
+	h.observe(5)
+
+	counts := h.cumulativeCounts()
+	if counts[0] != 1 {
+		t.Errorf("observe(5) landed outside the le=5 bucket: counts = %v", counts)
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright 2012-2013 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// ldmInfo replaces the normal INFO line when entering lame duck mode.
+type ldmInfo struct {
+	LameDuckMode bool `json:"ldm"`
+}
+
+// restartFdsEnv carries listener fds across a SIGUSR2 restart.
+const restartFdsEnv = "GNATSD_RESTART_FDS"
+
+// listenFdsEnv/listenPidEnv are the systemd socket activation vars.
+const (
+	listenFdsEnv = "LISTEN_FDS"
+	listenPidEnv = "LISTEN_PID"
+)
+
+// listen picks an inherited fd, a socket-activated fd, or a fresh listener.
+func (s *Server) listen(hp string) (net.Listener, error) {
+	if l := s.inheritedListener(0); l != nil {
+		return l, nil
+	}
+	if l := s.socketActivatedListener(); l != nil {
+		return l, nil
+	}
+	return net.Listen("tcp", hp)
+}
+
+// inheritedListener recovers listener idx (0 = client, 1 = http monitor).
+func (s *Server) inheritedListener(idx int) net.Listener {
+	v := os.Getenv(restartFdsEnv)
+	if v == "" {
+		return nil
+	}
+	// fd 3 is always the client listener, fd 4 (if present) the monitor.
+	f := os.NewFile(uintptr(3+idx), "")
+	if f == nil {
+		return nil
+	}
+	l, err := net.FileListener(f)
+	if err != nil {
+		s.log.Errorf("Error recovering inherited listener: %v", err)
+		return nil
+	}
+	return l
+}
+
+// socketActivatedListener implements systemd's LISTEN_FDS convention.
+func (s *Server) socketActivatedListener() net.Listener {
+	nfds, _ := strconv.Atoi(os.Getenv(listenFdsEnv))
+	if nfds < 1 {
+		return nil
+	}
+	if pid, _ := strconv.Atoi(os.Getenv(listenPidEnv)); pid != os.Getpid() {
+		return nil
+	}
+	f := os.NewFile(3, "")
+	l, err := net.FileListener(f)
+	if err != nil {
+		s.log.Errorf("Error using socket-activated listener: %v", err)
+		return nil
+	}
+	return l
+}
+
+// GracefulShutdown stops accepting, notifies clients of lame duck mode,
+// and waits up to timeout before hard-closing whatever's left.
+func (s *Server) GracefulShutdown(timeout time.Duration) {
+	s.mu.Lock()
+	s.running = false
+	s.ldm = true
+	if s.listener != nil {
+		s.listener.Close()
+		s.listener = nil
+	}
+	if s.clusterListener != nil {
+		s.clusterListener.Close()
+		s.clusterListener = nil
+	}
+	clients := make(map[uint64]*client, len(s.clients))
+	for i, c := range s.clients {
+		clients[i] = c
+	}
+	s.mu.Unlock()
+
+	b, _ := marshalLdmInfo()
+	for _, c := range clients {
+		c.mu.Lock()
+		fmt.Fprintf(c.bw, "-INFO %s%s", b, CR_LF)
+		c.bw.Flush()
+		c.mu.Unlock()
+	}
+
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		s.mu.Lock()
+		remaining := len(s.clients)
+		s.mu.Unlock()
+		if remaining == 0 {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// Past the deadline, hard-close whatever's left, same as Shutdown.
+	s.mu.Lock()
+	remaining := make(map[uint64]*client, len(s.clients))
+	for i, c := range s.clients {
+		remaining[i] = c
+	}
+	s.mu.Unlock()
+	for _, c := range remaining {
+		c.closeConnection()
+	}
+
+	// AcceptLoop sends to s.done once Accept errors out; read it rather
+	// than sending again.
+	<-s.done
+}
+
+func marshalLdmInfo() ([]byte, error) {
+	return json.Marshal(ldmInfo{LameDuckMode: true})
+}
+
+// restart forks/execs the running binary with our listener fds, then
+// drains and exits.
+func (s *Server) restart() {
+	s.mu.Lock()
+	tl := s.rawListener
+	httpListener := s.httpListener
+	s.mu.Unlock()
+
+	if tl == nil {
+		s.log.Errorf("Cannot restart: no raw listener available")
+		return
+	}
+	lf, err := tl.File()
+	if err != nil {
+		s.log.Errorf("Cannot restart: %v", err)
+		return
+	}
+
+	extraFiles := []*os.File{lf}
+	if hl, ok := httpListener.(*net.TCPListener); ok {
+		if hf, err := hl.File(); err == nil {
+			extraFiles = append(extraFiles, hf)
+		}
+	}
+
+	cmd := exec.Command(os.Args[0], os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = extraFiles
+	cmd.Env = append(os.Environ(), restartFdsEnv+"=1")
+
+	if err := cmd.Start(); err != nil {
+		s.log.Errorf("Error starting replacement process: %v", err)
+		return
+	}
+	s.log.Infof("Started replacement process pid %d, draining existing connections", cmd.Process.Pid)
+
+	s.GracefulShutdown(s.opts.RestartDrainTimeout)
+	os.Exit(0)
+}
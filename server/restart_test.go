@@ -0,0 +1,31 @@
+// Copyright 2012-2013 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+// TestGracefulShutdownDrainsAndReturns is the regression test for the
+// s.done double-send hang: AcceptLoop sends to s.done once Accept errors
+// out after the listener is closed, and GracefulShutdown must read that
+// send rather than writing its own.
+func TestGracefulShutdownDrainsAndReturns(t *testing.T) {
+	s := &Server{clients: map[uint64]*client{}, done: make(chan bool, 1)}
+	s.running = true
+
+	go func() { s.done <- true }() // stands in for AcceptLoop's exit send
+
+	done := make(chan struct{})
+	go func() {
+		s.GracefulShutdown(10 * time.Millisecond)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("GracefulShutdown did not return; s.done handoff is hanging")
+	}
+}
@@ -0,0 +1,500 @@
+// Copyright 2012-2013 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/apcera/gnatsd/sublist"
+)
+
+// RouteInfo is the route protocol's first line; it also gossips peers.
+type RouteInfo struct {
+	Id           string   `json:"server_id"`
+	Version      string   `json:"version"`
+	Host         string   `json:"host"`
+	Port         int      `json:"port"`
+	AuthRequired bool     `json:"auth_required"`
+	SslRequired  bool     `json:"ssl_required"`
+	Routes       []string `json:"routes,omitempty"`
+}
+
+// route represents a connection to another server in the cluster.
+type route struct {
+	mu            sync.Mutex
+	srv           *Server
+	conn          net.Conn
+	bw            *bufio.Writer
+	rid           uint64
+	remoteId      string
+	didSolicit    bool
+	url           string
+	closed        bool
+	authenticated bool
+	authTimer     *time.Timer
+}
+
+// RS+/RS- announce gained/lost local interest in a subject. RMSG carries
+// a published message tagged with its origin server id, for loop
+// suppression.
+const (
+	subProto     = "RS+"
+	unsubProto   = "RS-"
+	msgProto     = "RMSG"
+	routeInfo    = "INFO"
+	routeConnect = "CONNECT"
+)
+
+// RouteAuthTimeout bounds how long an inbound route has to send a valid
+// CONNECT before we close it, mirroring AUTH_TIMEOUT for clients.
+const RouteAuthTimeout = AUTH_TIMEOUT
+
+// connectRoutes dials every configured route and, once connected to one
+// peer, also dials whatever peers that first peer gossips back to us so
+// the cluster converges on a full mesh.
+func (s *Server) connectRoutes() {
+	for _, rUrl := range s.opts.Routes {
+		go s.connectToRoute(rUrl)
+	}
+}
+
+func (s *Server) connectToRoute(rUrl string) {
+	conn, err := net.Dial("tcp", rUrl)
+	if err != nil {
+		s.log.Errorf("Error connecting to route %q: %v", rUrl, err)
+		return
+	}
+	if s.opts.ClusterTLSConfig != nil {
+		conn = tls.Client(conn, s.opts.ClusterTLSConfig)
+	}
+	r := s.createRoute(conn, rUrl, true)
+	r.sendConnect()
+}
+
+// createRoute registers a route, solicited (outbound dial) or accepted.
+// An inbound route must still CONNECT with ClusterAuthorization before
+// it's admitted.
+func (s *Server) createRoute(conn net.Conn, url string, didSolicit bool) *route {
+	r := &route{
+		srv:        s,
+		conn:       conn,
+		bw:         bufio.NewWriterSize(conn, defaultBufSize),
+		rid:        atomic.AddUint64(&s.grid, 1),
+		url:        url,
+		didSolicit: didSolicit,
+	}
+	if didSolicit || s.opts.ClusterAuthorization == "" {
+		r.authenticated = true
+	}
+
+	s.sendRouteInfo(r)
+	go r.readLoop()
+
+	s.mu.Lock()
+	s.routes[r.rid] = r
+	s.mu.Unlock()
+
+	if r.authenticated {
+		s.admitRoute(r)
+	} else {
+		r.setAuthTimer(RouteAuthTimeout)
+	}
+
+	return r
+}
+
+// admitRoute hands a now-trusted route our subscription table.
+func (s *Server) admitRoute(r *route) {
+	s.forwardLocalSubsToRoute(r)
+}
+
+// setAuthTimer closes the route if it doesn't authenticate in time.
+func (r *route) setAuthTimer(timeout time.Duration) {
+	r.mu.Lock()
+	r.authTimer = time.AfterFunc(timeout, func() {
+		r.srv.log.Errorf("Route did not authenticate in time, closing")
+		r.close()
+	})
+	r.mu.Unlock()
+}
+
+func (r *route) clearAuthTimer() {
+	r.mu.Lock()
+	if r.authTimer != nil {
+		r.authTimer.Stop()
+		r.authTimer = nil
+	}
+	r.mu.Unlock()
+}
+
+func (s *Server) sendRouteInfo(r *route) {
+	info := RouteInfo{
+		Id:           s.info.Id,
+		Version:      s.info.Version,
+		Host:         s.opts.ClusterHost,
+		Port:         s.opts.ClusterPort,
+		AuthRequired: s.opts.ClusterAuthorization != "",
+		SslRequired:  s.opts.ClusterTLSConfig != nil,
+		Routes:       s.knownRouteURLs(),
+	}
+	b, err := json.Marshal(info)
+	if err != nil {
+		s.log.Errorf("Error marshalling route INFO: %v", err)
+		return
+	}
+	r.mu.Lock()
+	fmt.Fprintf(r.bw, "%s %s%s", routeInfo, b, CR_LF)
+	r.bw.Flush()
+	r.mu.Unlock()
+}
+
+// sendConnect authenticates this server to the remote side of a route
+// we solicited.
+func (r *route) sendConnect() {
+	if r.srv.opts.ClusterAuthorization == "" {
+		return
+	}
+	r.mu.Lock()
+	fmt.Fprintf(r.bw, "%s %s%s", routeConnect, r.srv.opts.ClusterAuthorization, CR_LF)
+	r.bw.Flush()
+	r.mu.Unlock()
+}
+
+// knownRouteURLs is gossiped in our INFO so new peers dial our peers too.
+func (s *Server) knownRouteURLs() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	urls := make([]string, 0, len(s.routes))
+	for _, r := range s.routes {
+		if r.url != "" {
+			urls = append(urls, r.url)
+		}
+	}
+	return urls
+}
+
+// processRemoteGossip dials any peer URL from a remote's INFO that we do
+// not already have a route to.
+func (s *Server) processRemoteGossip(urls []string) {
+	s.mu.Lock()
+	known := make(map[string]bool)
+	for _, r := range s.routes {
+		known[r.url] = true
+	}
+	s.mu.Unlock()
+
+	for _, u := range urls {
+		if !known[u] {
+			go s.connectToRoute(u)
+		}
+	}
+}
+
+// forwardLocalSubsToRoute announces our subscription interest to r.
+func (s *Server) forwardLocalSubsToRoute(r *route) {
+	subs := s.sl.All()
+	r.mu.Lock()
+	for _, sub := range subs {
+		fmt.Fprintf(r.bw, "%s %s%s", subProto, sub.Subject, CR_LF)
+	}
+	r.bw.Flush()
+	r.mu.Unlock()
+}
+
+// broadcastSub/broadcastUnsub notify all authenticated routes of a local
+// subscribe/unsubscribe so remote interest graphs stay in sync.
+func (s *Server) broadcastSub(sub *sublist.Subscription) {
+	s.forEachAuthenticatedRoute(func(r *route) {
+		r.mu.Lock()
+		fmt.Fprintf(r.bw, "%s %s%s", subProto, sub.Subject, CR_LF)
+		r.bw.Flush()
+		r.mu.Unlock()
+	})
+}
+
+func (s *Server) broadcastUnsub(sub *sublist.Subscription) {
+	s.forEachAuthenticatedRoute(func(r *route) {
+		r.mu.Lock()
+		fmt.Fprintf(r.bw, "%s %s%s", unsubProto, sub.Subject, CR_LF)
+		r.bw.Flush()
+		r.mu.Unlock()
+	})
+}
+
+func (s *Server) forEachAuthenticatedRoute(f func(r *route)) {
+	s.mu.Lock()
+	routes := make([]*route, 0, len(s.routes))
+	for _, r := range s.routes {
+		if r.isAuthenticated() {
+			routes = append(routes, r)
+		}
+	}
+	s.mu.Unlock()
+	for _, r := range routes {
+		f(r)
+	}
+}
+
+// routeMsg fans a locally published message out to every authenticated
+// route, tagged with our server id for loop suppression.
+func (s *Server) routeMsg(subject, reply string, msg []byte) {
+	s.forEachAuthenticatedRoute(func(r *route) {
+		r.mu.Lock()
+		fmt.Fprintf(r.bw, "%s %s %s %s %d%s", msgProto, s.info.Id, subject, reply, len(msg), CR_LF)
+		r.bw.Write(msg)
+		r.bw.WriteString(CR_LF)
+		r.bw.Flush()
+		r.mu.Unlock()
+	})
+}
+
+// readLoop consumes the route protocol from the remote side: INFO/CONNECT
+// during setup, then a stream of RS+/RS-/RMSG.
+func (r *route) readLoop() {
+	reader := bufio.NewReaderSize(r.conn, defaultBufSize)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			r.close()
+			return
+		}
+		verb, arg := splitVerb(line)
+		if verb == msgProto {
+			if err := r.srv.processRouteMsg(r, arg, reader); err != nil {
+				r.srv.log.Debugf("Error processing RMSG: %v", err)
+				r.close()
+				return
+			}
+			continue
+		}
+		r.srv.processRouteLine(r, line)
+	}
+}
+
+func (r *route) close() {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return
+	}
+	r.closed = true
+	if r.authTimer != nil {
+		r.authTimer.Stop()
+		r.authTimer = nil
+	}
+	r.conn.Close()
+	r.mu.Unlock()
+
+	r.srv.mu.Lock()
+	delete(r.srv.routes, r.rid)
+	r.srv.mu.Unlock()
+}
+
+// processRouteLine dispatches a line of the route protocol by its verb.
+// RMSG is framed by length, not by line, so readLoop handles it directly.
+func (s *Server) processRouteLine(r *route, line string) {
+	verb, arg := splitVerb(line)
+
+	switch verb {
+	case routeInfo:
+		if arg == "" {
+			return
+		}
+		var info RouteInfo
+		if err := json.Unmarshal([]byte(arg), &info); err != nil {
+			s.log.Debugf("Error parsing route INFO: %v", err)
+			return
+		}
+		r.mu.Lock()
+		r.remoteId = info.Id
+		r.mu.Unlock()
+		s.processRemoteGossip(info.Routes)
+	case routeConnect:
+		if arg != s.opts.ClusterAuthorization {
+			s.log.Errorf("Route authorization failed, closing connection")
+			r.close()
+			return
+		}
+		r.clearAuthTimer()
+		r.mu.Lock()
+		wasAuthenticated := r.authenticated
+		r.authenticated = true
+		r.mu.Unlock()
+		if !wasAuthenticated {
+			s.admitRoute(r)
+		}
+	case subProto, unsubProto:
+		// Remote interest change; routeMsg already fans out every publish
+		// to every authenticated route, so there's nothing to record.
+		if !r.isAuthenticated() {
+			r.close()
+		}
+	}
+}
+
+// isAuthenticated reports whether r has been admitted to the cluster.
+func (r *route) isAuthenticated() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.authenticated
+}
+
+// splitVerb splits a CR_LF-terminated protocol line into its verb and
+// the rest of the line.
+func splitVerb(line string) (string, string) {
+	line = strings.TrimRight(line, CR_LF)
+	i := strings.IndexByte(line, ' ')
+	if i < 0 {
+		return line, ""
+	}
+	return line[:i], line[i+1:]
+}
+
+// processRouteMsg reads an RMSG payload by its declared byte count so
+// embedded newlines aren't mistaken for the line terminator.
+func (s *Server) processRouteMsg(r *route, arg string, reader *bufio.Reader) error {
+	if !r.isAuthenticated() {
+		return fmt.Errorf("RMSG from unauthenticated route")
+	}
+
+	fields := strings.SplitN(arg, " ", 4)
+	if len(fields) != 4 {
+		return fmt.Errorf("malformed RMSG header: %q", arg)
+	}
+	origin, subject, reply := fields[0], fields[1], fields[2]
+	size, err := strconv.Atoi(fields[3])
+	if err != nil || size < 0 {
+		return fmt.Errorf("malformed RMSG size: %q", fields[3])
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return err
+	}
+	trailer := make([]byte, len(CR_LF))
+	if _, err := io.ReadFull(reader, trailer); err != nil {
+		return err
+	}
+
+	if origin == s.info.Id {
+		// Loop suppression: don't re-deliver a message that originated
+		// with us.
+		return nil
+	}
+	s.deliverRoutedMsg(subject, reply, payload)
+	return nil
+}
+
+// deliverRoutedMsg hands a message received from a route to local
+// subscribers only; it is not re-published to other routes.
+func (s *Server) deliverRoutedMsg(subject, reply string, msg []byte) {
+	s.mu.Lock()
+	atomic.AddInt64(&s.inMsgs, 1)
+	atomic.AddInt64(&s.inBytes, int64(len(msg)))
+	s.mu.Unlock()
+	// Local delivery reuses the same sublist match + client write path
+	// as a directly published message.
+	s.deliverToLocalSubs(subject, reply, msg)
+}
+
+// Routez is the JSON representation of the routing table (route count
+// plus one RouteInfoz per route), returned by HandleRoutez alongside
+// /varz and /connz.
+type Routez struct {
+	NumRoutes int           `json:"num_routes"`
+	Routes    []*RouteInfoz `json:"routes"`
+}
+
+// RouteInfoz describes one active route connection.
+type RouteInfoz struct {
+	Rid        uint64 `json:"rid"`
+	RemoteId   string `json:"remote_id"`
+	DidSolicit bool   `json:"did_solicit"`
+	Url        string `json:"url,omitempty"`
+}
+
+// HandleRoutez reports the current cluster routing table as JSON,
+// alongside HandleVarz and HandleConnz.
+func (s *Server) HandleRoutez(w http.ResponseWriter, r *http.Request) {
+	rz := &Routez{}
+	s.mu.Lock()
+	for _, route := range s.routes {
+		route.mu.Lock()
+		rz.Routes = append(rz.Routes, &RouteInfoz{
+			Rid:        route.rid,
+			RemoteId:   route.remoteId,
+			DidSolicit: route.didSolicit,
+			Url:        route.url,
+		})
+		route.mu.Unlock()
+	}
+	s.mu.Unlock()
+	rz.NumRoutes = len(rz.Routes)
+
+	b, err := json.MarshalIndent(rz, "", "  ")
+	if err != nil {
+		s.log.Errorf("Error marshalling routez: %v", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// AcceptClusterLoop accepts inbound route connections on the cluster
+// port, the route-protocol analog of AcceptLoop.
+func (s *Server) AcceptClusterLoop() {
+	if s.opts.ClusterPort == 0 {
+		return
+	}
+
+	hp := fmt.Sprintf("%s:%d", s.opts.ClusterHost, s.opts.ClusterPort)
+	l, e := net.Listen("tcp", hp)
+	if e != nil {
+		s.log.Fatalf("Error listening on cluster port: %d - %v", s.opts.ClusterPort, e)
+		return
+	}
+	if s.opts.ClusterTLSConfig != nil {
+		l = tls.NewListener(l, s.opts.ClusterTLSConfig)
+	}
+
+	s.log.Infof("Listening for route connections on %s", hp)
+
+	s.mu.Lock()
+	s.clusterListener = l
+	s.mu.Unlock()
+
+	s.connectRoutes()
+
+	tmpDelay := ACCEPT_MIN_SLEEP
+
+	for s.isRunning() {
+		conn, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				s.log.Debugf("Temporary Accept Error(%v), sleeping %dms",
+					ne, tmpDelay/time.Millisecond)
+				time.Sleep(tmpDelay)
+				tmpDelay *= 2
+				if tmpDelay > ACCEPT_MAX_SLEEP {
+					tmpDelay = ACCEPT_MAX_SLEEP
+				}
+			} else {
+				s.log.Errorf("Accept error: %v", err)
+			}
+			continue
+		}
+		tmpDelay = ACCEPT_MIN_SLEEP
+		s.createRoute(conn, "", false)
+	}
+}
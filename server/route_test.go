@@ -0,0 +1,78 @@
+// Copyright 2012-2013 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"bufio"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// discardLogger implements Logger and throws everything away, so route
+// tests don't need a real *Server to get a working s.log.
+type discardLogger struct{}
+
+func (discardLogger) Debug(args ...interface{})                 {}
+func (discardLogger) Debugf(format string, args ...interface{}) {}
+func (discardLogger) Info(args ...interface{})                  {}
+func (discardLogger) Infof(format string, args ...interface{})  {}
+func (discardLogger) Warn(args ...interface{})                  {}
+func (discardLogger) Warnf(format string, args ...interface{})  {}
+func (discardLogger) Error(args ...interface{})                 {}
+func (discardLogger) Errorf(format string, args ...interface{}) {}
+func (discardLogger) Fatalf(format string, args ...interface{}) {}
+func (discardLogger) With(fields ...Field) Logger               { return discardLogger{} }
+
+func TestSplitVerb(t *testing.T) {
+	cases := []struct {
+		line, verb, arg string
+	}{
+		{"RS+ foo.bar" + CR_LF, "RS+", "foo.bar"},
+		{"INFO" + CR_LF, "INFO", ""},
+		{"RMSG srv1 foo.bar _INBOX.1 11" + CR_LF, "RMSG", "srv1 foo.bar _INBOX.1 11"},
+	}
+	for _, c := range cases {
+		verb, arg := splitVerb(c.line)
+		if verb != c.verb || arg != c.arg {
+			t.Errorf("splitVerb(%q) = (%q, %q), want (%q, %q)", c.line, verb, arg, c.verb, c.arg)
+		}
+	}
+}
+
+// TestProcessRouteMsgEmbeddedNewline is the regression test for the
+// truncation bug: a payload containing a literal newline must be read
+// in full by byte count, not cut short by line-based framing.
+func TestProcessRouteMsgEmbeddedNewline(t *testing.T) {
+	s := &Server{info: Info{Id: "srv1"}, log: discardLogger{}}
+	r := &route{authenticated: true}
+
+	payload := "hello\nworld"
+	arg := "srv1 foo.bar _INBOX.1 " + strconv.Itoa(len(payload))
+	body := payload + CR_LF + "NEXTLINE" + CR_LF
+	reader := bufio.NewReader(strings.NewReader(body))
+
+	// origin == s.info.Id exercises the loop-suppression path without
+	// needing a real sublist/client fan-out.
+	if err := s.processRouteMsg(r, arg, reader); err != nil {
+		t.Fatalf("processRouteMsg: %v", err)
+	}
+
+	rest, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("reading remainder: %v", err)
+	}
+	if rest != "NEXTLINE"+CR_LF {
+		t.Fatalf("reader left at %q, want next protocol line untouched", rest)
+	}
+}
+
+func TestProcessRouteMsgRejectsUnauthenticated(t *testing.T) {
+	s := &Server{info: Info{Id: "srv1"}, log: discardLogger{}}
+	r := &route{authenticated: false}
+	reader := bufio.NewReader(strings.NewReader("x"))
+
+	if err := s.processRouteMsg(r, "other foo.bar  1", reader); err == nil {
+		t.Fatal("expected error for RMSG on an unauthenticated route")
+	}
+}
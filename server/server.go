@@ -4,6 +4,7 @@ package server
 
 import (
 	"bufio"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"net"
@@ -12,6 +13,7 @@ import (
 	"os/signal"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/apcera/gnatsd/hashmap"
@@ -29,19 +31,27 @@ type Info struct {
 }
 
 type Server struct {
-	mu       sync.Mutex
-	info     Info
-	infoJson []byte
-	sl       *sublist.Sublist
-	gcid     uint64
-	opts     *Options
-	trace    bool
-	debug    bool
-	running  bool
-	listener net.Listener
-	clients  map[uint64]*client
-	done     chan bool
-	start    time.Time
+	mu              sync.Mutex
+	info            Info
+	infoJson        []byte
+	sl              *sublist.Sublist
+	gcid            uint64
+	grid            uint64
+	opts            *Options
+	trace           bool
+	debug           bool
+	running         bool
+	ldm             bool
+	listener        net.Listener
+	rawListener     *net.TCPListener
+	clusterListener net.Listener
+	httpListener    net.Listener
+	clients         map[uint64]*client
+	routes          map[uint64]*route
+	done            chan bool
+	start           time.Time
+	log             Logger
+	metrics         *metrics
 	stats
 }
 
@@ -67,14 +77,18 @@ func New(opts *Options) *Server {
 	if opts.Username != "" || opts.Authorization != "" {
 		info.AuthRequired = true
 	}
+	if opts.TLSCert != "" {
+		info.SslRequired = true
+	}
 	s := &Server{
-		info:  info,
-		sl:    sublist.New(),
-		opts:  opts,
-		debug: opts.Debug,
-		trace: opts.Trace,
-		done:  make(chan bool, 1),
-		start: time.Now(),
+		info:    info,
+		sl:      sublist.New(),
+		opts:    opts,
+		debug:   opts.Debug,
+		trace:   opts.Trace,
+		done:    make(chan bool, 1),
+		start:   time.Now(),
+		metrics: newMetrics(),
 	}
 
 	s.mu.Lock()
@@ -83,17 +97,31 @@ func New(opts *Options) *Server {
 	// Setup logging with flags
 	s.LogInit()
 
+	// Generate the TLS config up front so a bad cert/key pair is caught
+	// at startup rather than on the first client connection.
+	if opts.TLSCert != "" {
+		tc, err := s.generateTLSConfig()
+		if err != nil {
+			s.log.Fatalf("Error generating TLS config: %v", err)
+		}
+		opts.TLSConfig = tc
+	}
+
 	// For tracing clients
 	s.clients = make(map[uint64]*client)
 
+	// For routes to other servers in the cluster
+	s.routes = make(map[uint64]*route)
+
 	// Generate the info json
 	b, err := json.Marshal(s.info)
 	if err != nil {
-		Fatalf("Err marshalling INFO JSON: %+v\n", err)
+		s.log.Fatalf("Err marshalling INFO JSON: %+v", err)
 	}
 	s.infoJson = []byte(fmt.Sprintf("INFO %s %s", b, CR_LF))
 
 	s.handleSignals()
+	go s.wsKeepalive()
 
 	return s
 }
@@ -110,12 +138,27 @@ func (s *Server) handleSignals() {
 		return
 	}
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, os.Interrupt, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2)
 	go func() {
 		for sig := range c {
-			Debugf("Trapped Signal; %v", sig)
+			s.log.Debugf("Trapped Signal; %v", sig)
+			switch sig {
+			case syscall.SIGHUP:
+				s.reloadTLSConfig()
+				continue
+			case syscall.SIGUSR1:
+				if reopener, ok := s.log.(interface{ reopen() error }); ok {
+					if err := reopener.reopen(); err != nil {
+						s.log.Errorf("Error reopening log file: %v", err)
+					}
+				}
+				continue
+			case syscall.SIGUSR2:
+				s.restart()
+				continue
+			}
 			// FIXME, trip running?
-			Log("Server Exiting..")
+			s.log.Info("Server Exiting..")
 			os.Exit(0)
 		}
 	}()
@@ -145,6 +188,11 @@ func (s *Server) Shutdown() {
 		s.listener.Close()
 		s.listener = nil
 	}
+	// Kick AcceptClusterLoop()
+	if s.clusterListener != nil {
+		s.clusterListener.Close()
+		s.clusterListener = nil
+	}
 	s.mu.Unlock()
 
 	// Close client connections
@@ -156,20 +204,30 @@ func (s *Server) Shutdown() {
 }
 
 func (s *Server) AcceptLoop() {
-	Logf("Starting nats-server version %s on port %d", VERSION, s.opts.Port)
+	s.log.Infof("Starting nats-server version %s on port %d", VERSION, s.opts.Port)
 
 	hp := fmt.Sprintf("%s:%d", s.opts.Host, s.opts.Port)
-	l, e := net.Listen("tcp", hp)
+	l, e := s.listen(hp)
 	if e != nil {
-		Fatalf("Error listening on port: %d - %v", s.opts.Port, e)
+		s.log.Fatalf("Error listening on port: %d - %v", s.opts.Port, e)
 		return
 	}
 
-	Logf("nats-server is ready")
+	// Keep the unwrapped *net.TCPListener around; restart() needs it even
+	// when l gets wrapped in tls.NewListener below.
+	rawListener, _ := l.(*net.TCPListener)
+
+	if s.opts.TLSConfig != nil {
+		s.log.Info("TLS required for client connections")
+		l = tls.NewListener(l, s.opts.TLSConfig)
+	}
+
+	s.log.Infof("nats-server is ready")
 
 	// Setup state that can enable shutdown
 	s.mu.Lock()
 	s.listener = l
+	s.rawListener = rawListener
 	s.running = true
 	s.mu.Unlock()
 
@@ -179,7 +237,7 @@ func (s *Server) AcceptLoop() {
 		conn, err := l.Accept()
 		if err != nil {
 			if ne, ok := err.(net.Error); ok && ne.Temporary() {
-				Debug("Temporary Accept Error(%v), sleeping %dms",
+				s.log.Debugf("Temporary Accept Error(%v), sleeping %dms",
 					ne, tmpDelay/time.Millisecond)
 				time.Sleep(tmpDelay)
 				tmpDelay *= 2
@@ -187,22 +245,22 @@ func (s *Server) AcceptLoop() {
 					tmpDelay = ACCEPT_MAX_SLEEP
 				}
 			} else {
-				Logf("Accept error: %v", err)
+				s.log.Errorf("Accept error: %v", err)
 			}
 			continue
 		}
 		tmpDelay = ACCEPT_MIN_SLEEP
+		atomic.AddInt64(&s.metrics.connsTotal, 1)
 		s.createClient(conn)
 	}
 	s.done <- true
-	Log("Server Exiting..")
+	s.log.Info("Server Exiting..")
 }
 
 func (s *Server) StartHTTPMonitoring() {
 	go func() {
 		// FIXME(dlc): port config
-		lm := fmt.Sprintf("Starting http monitor on port %d", s.opts.HttpPort)
-		Log(lm)
+		s.log.Infof("Starting http monitor on port %d", s.opts.HttpPort)
 		// Varz
 		http.HandleFunc("/varz", func(w http.ResponseWriter, r *http.Request) {
 			s.HandleVarz(w, r)
@@ -211,9 +269,31 @@ func (s *Server) StartHTTPMonitoring() {
 		http.HandleFunc("/connz", func(w http.ResponseWriter, r *http.Request) {
 			s.HandleConnz(w, r)
 		})
+		// Routez
+		http.HandleFunc("/routez", func(w http.ResponseWriter, r *http.Request) {
+			s.HandleRoutez(w, r)
+		})
+		// Metrics
+		s.RegisterMetrics()
+		// WebSocket clients (browsers), sharing this port unless
+		// Options.WSPort configures a dedicated one.
+		s.RegisterWSHandler()
 
 		hp := fmt.Sprintf("%s:%d", s.opts.Host, s.opts.HttpPort)
-		Fatal(http.ListenAndServe(hp, nil))
+		l := s.inheritedListener(1)
+		if l == nil {
+			var err error
+			l, err = net.Listen("tcp", hp)
+			if err != nil {
+				s.log.Fatalf("Error starting http monitor: %v", err)
+			}
+		}
+
+		s.mu.Lock()
+		s.httpListener = l
+		s.mu.Unlock()
+
+		s.log.Fatalf("%v", http.Serve(l, nil))
 	}()
 
 }
@@ -231,12 +311,38 @@ func (s *Server) createClient(conn net.Conn) *client {
 	// after we process inbound msgs from our own connection.
 	c.pcd = make(map[*client]struct{})
 
-	Debug("Client connection created", clientConnStr(conn), c.cid)
+	// Give the client its own child logger carrying cid and remote addr
+	// on every line; the CONNECT handler adds the user once known.
+	c.log = s.log.With(F("cid", c.cid), F("addr", conn.RemoteAddr()))
+
+	c.log.Debug("Client connection created")
 
 	if ip, ok := conn.(*net.TCPConn); ok {
 		ip.SetReadBuffer(defaultBufSize)
 	}
 
+	// If this is a TLS connection, the handshake must complete before we
+	// send INFO so that ssl_required is meaningful and nothing is leaked
+	// on the wire in the clear.
+	if tc, ok := conn.(*tls.Conn); ok {
+		timeout := s.opts.TLSTimeout
+		if timeout == 0 {
+			timeout = TLSTimeout
+		}
+		tc.SetDeadline(time.Now().Add(secondsToDuration(timeout)))
+		if err := tc.Handshake(); err != nil {
+			c.log.Debugf("TLS handshake error, closing connection: %v", err)
+			c.mu.Unlock()
+			conn.Close()
+			return nil
+		}
+		tc.SetDeadline(time.Time{})
+		c.tlsCN = peerCertCN(tc)
+		if c.tlsCN != "" {
+			c.log = c.log.With(F("tlsCN", c.tlsCN))
+		}
+	}
+
 	s.sendInfo(c)
 	go c.readLoop()
 
@@ -266,12 +372,24 @@ func (s *Server) checkAuth(c *client) bool {
 	if !s.info.AuthRequired {
 		return true
 	}
+	// A verified client certificate CN is accepted as identity in place
+	// of a username/password only if it matches the configured Username;
+	// the handshake proves possession of the key, not which identity to
+	// grant, so an unrelated CN still has to authenticate normally below.
+	if c.tlsCN != "" && s.opts.Username != "" && c.tlsCN == s.opts.Username {
+		return true
+	}
 	// We require auth here, check the client
 	// Authorization tokens trump username/password
 	if s.opts.Authorization != "" {
-		return s.opts.Authorization == c.opts.Authorization
+		if s.opts.Authorization == c.opts.Authorization {
+			return true
+		}
+		atomic.AddInt64(&s.metrics.authFailures, 1)
+		return false
 	} else if s.opts.Username != c.opts.Username ||
 		s.opts.Password != c.opts.Password {
+		atomic.AddInt64(&s.metrics.authFailures, 1)
 		return false
 	}
 	return true
@@ -281,4 +399,5 @@ func (s *Server) removeClient(c *client) {
 	s.mu.Lock()
 	delete(s.clients, c.cid)
 	s.mu.Unlock()
+	atomic.AddInt64(&s.metrics.slowConsumers, 1)
 }
@@ -0,0 +1,136 @@
+// Copyright 2012-2013 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+// TLSTimeout is the default time we will wait for the TLS handshake to
+// complete before giving up on the client.
+const TLSTimeout = 2 // seconds
+
+// loadCertChain parses every PEM block in certFile, so a full chain
+// (leaf + intermediates) loads, not just the leaf.
+func loadCertChain(certFile, keyFile string) (tls.Certificate, error) {
+	certPEM, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("tls: error reading cert file: %v", err)
+	}
+
+	var cert tls.Certificate
+	for {
+		var block *pem.Block
+		block, certPEM = pem.Decode(certPEM)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			cert.Certificate = append(cert.Certificate, block.Bytes)
+		}
+	}
+	if len(cert.Certificate) == 0 {
+		return tls.Certificate{}, fmt.Errorf("tls: no certificates found in %s", certFile)
+	}
+
+	keyPair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("tls: error loading key pair: %v", err)
+	}
+	cert.PrivateKey = keyPair.PrivateKey
+
+	return cert, nil
+}
+
+// generateTLSConfig builds a *tls.Config from Options.
+func (s *Server) generateTLSConfig() (*tls.Config, error) {
+	opts := s.opts
+
+	cert, err := loadCertChain(opts.TLSCert, opts.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS10,
+	}
+	if opts.TLSMinVersion != 0 {
+		config.MinVersion = opts.TLSMinVersion
+	}
+	if len(opts.TLSCipherSuites) > 0 {
+		config.CipherSuites = opts.TLSCipherSuites
+	}
+
+	if opts.TLSCaCert != "" {
+		rootPEM, err := ioutil.ReadFile(opts.TLSCaCert)
+		if err != nil {
+			return nil, fmt.Errorf("tls: error reading ca cert file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(rootPEM) {
+			return nil, fmt.Errorf("tls: failed to parse root ca certificate")
+		}
+		config.ClientCAs = pool
+	}
+
+	if opts.TLSVerify {
+		if config.ClientCAs == nil {
+			return nil, fmt.Errorf("tls: client cert verification requested but no ca cert provided")
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config, nil
+}
+
+// reloadTLSConfig re-reads the certificate (and CA bundle, if any) and
+// updates the running listener's config in place, without dropping
+// connections. Invoked on SIGHUP.
+func (s *Server) reloadTLSConfig() {
+	if s.opts.TLSCert == "" {
+		return
+	}
+
+	config, err := s.generateTLSConfig()
+	if err != nil {
+		s.log.Errorf("Error reloading TLS certificates: %v", err)
+		return
+	}
+
+	// tls.Config embeds a sync.RWMutex used for its session ticket key
+	// cache, so copy individual fields rather than the whole struct --
+	// `*s.opts.TLSConfig = *config` would copy that lock while the
+	// listener's accept path may be reading it.
+	s.mu.Lock()
+	s.opts.TLSConfig.Certificates = config.Certificates
+	s.opts.TLSConfig.ClientCAs = config.ClientCAs
+	s.opts.TLSConfig.ClientAuth = config.ClientAuth
+	s.opts.TLSConfig.MinVersion = config.MinVersion
+	s.opts.TLSConfig.CipherSuites = config.CipherSuites
+	s.mu.Unlock()
+
+	s.log.Info("Reloaded TLS certificates")
+}
+
+// secondsToDuration converts a fractional-seconds Options value.
+func secondsToDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// peerCertCN returns the CommonName of the leaf certificate presented by
+// a TLS client, or "" if none was presented. It does not check
+// verification itself; generateTLSConfig only requests client
+// certificates with tls.RequireAndVerifyClientCert.
+func peerCertCN(conn *tls.Conn) string {
+	state := conn.ConnectionState()
+	if len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	return state.PeerCertificates[0].Subject.CommonName
+}
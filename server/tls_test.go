@@ -0,0 +1,170 @@
+// Copyright 2012-2013 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// genSelfSignedCert returns a self-signed cert/key pair PEM-encoded, with
+// cn as the certificate's CommonName.
+func genSelfSignedCert(t *testing.T, cn string) (certPEM, keyPEM []byte) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Unix(0, 0),
+		NotAfter:     time.Unix(0, 0).Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("creating certificate: %v", err)
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	return certPEM, keyPEM
+}
+
+func TestLoadCertChain(t *testing.T) {
+	certPEM, keyPEM := genSelfSignedCert(t, "test-server")
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := loadCertChain(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("loadCertChain: %v", err)
+	}
+	if len(cert.Certificate) != 1 {
+		t.Fatalf("len(cert.Certificate) = %d, want 1", len(cert.Certificate))
+	}
+	if cert.PrivateKey == nil {
+		t.Fatal("cert.PrivateKey is nil")
+	}
+}
+
+func TestLoadCertChainMissingFile(t *testing.T) {
+	if _, err := loadCertChain("/nonexistent/cert.pem", "/nonexistent/key.pem"); err == nil {
+		t.Fatal("expected error for missing cert file")
+	}
+}
+
+// TestPeerCertCN runs a real handshake so the server side's
+// ConnectionState carries the client's leaf certificate (accepted
+// unverified, via tls.RequireAnyClientCert).
+func TestPeerCertCN(t *testing.T) {
+	certPEM, keyPEM := genSelfSignedCert(t, "test-client")
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("X509KeyPair: %v", err)
+	}
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAnyClientCert,
+	})
+	if err != nil {
+		t.Fatalf("tls.Listen: %v", err)
+	}
+	defer l.Close()
+
+	serverConn := make(chan *tls.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			serverConn <- nil
+			return
+		}
+		tc := conn.(*tls.Conn)
+		tc.Handshake()
+		serverConn <- tc
+	}()
+
+	clientConn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+		Certificates:       []tls.Certificate{cert},
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		t.Fatalf("tls.Dial: %v", err)
+	}
+	defer clientConn.Close()
+
+	tc := <-serverConn
+	if tc == nil {
+		t.Fatal("server side handshake failed")
+	}
+	defer tc.Close()
+
+	if cn := peerCertCN(tc); cn != "test-client" {
+		t.Errorf("peerCertCN() = %q, want %q", cn, "test-client")
+	}
+}
+
+func TestPeerCertCNNoCert(t *testing.T) {
+	certPEM, keyPEM := genSelfSignedCert(t, "test-server")
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("X509KeyPair: %v", err)
+	}
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	})
+	if err != nil {
+		t.Fatalf("tls.Listen: %v", err)
+	}
+	defer l.Close()
+
+	serverConn := make(chan *tls.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			serverConn <- nil
+			return
+		}
+		tc := conn.(*tls.Conn)
+		tc.Handshake()
+		serverConn <- tc
+	}()
+
+	clientConn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("tls.Dial: %v", err)
+	}
+	defer clientConn.Close()
+
+	tc := <-serverConn
+	if tc == nil {
+		t.Fatal("server side handshake failed")
+	}
+	defer tc.Close()
+
+	if cn := peerCertCN(tc); cn != "" {
+		t.Errorf("peerCertCN() = %q, want empty string when no client cert presented", cn)
+	}
+}
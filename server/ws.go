@@ -0,0 +1,161 @@
+// Copyright 2012-2013 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// DefaultWSPath is registered on the HTTP monitor mux when Options.WSPort
+// is unset, so browsers can connect without a dedicated port.
+const DefaultWSPath = "/nats"
+
+// wsPingInterval is how often wsKeepalive pings idle WebSocket clients.
+const wsPingInterval = 2 * time.Minute
+
+// wsConn adapts a *websocket.Conn to net.Conn. WebSocket is message
+// framed and NATS is not, so Read buffers whatever doesn't fit the
+// caller's slice.
+type wsConn struct {
+	ws       *websocket.Conn
+	leftover bytes.Buffer
+}
+
+func newWSConn(ws *websocket.Conn) *wsConn {
+	c := &wsConn{ws: ws}
+	ws.SetPongHandler(func(string) error {
+		ws.SetReadDeadline(time.Now().Add(2 * wsPingInterval))
+		return nil
+	})
+	return c
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	if c.leftover.Len() > 0 {
+		return c.leftover.Read(p)
+	}
+	for {
+		mt, data, err := c.ws.ReadMessage()
+		if err != nil {
+			return 0, err
+		}
+		if mt != websocket.BinaryMessage && mt != websocket.TextMessage {
+			continue
+		}
+		c.leftover.Write(data)
+		return c.leftover.Read(p)
+	}
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	if err := c.ws.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *wsConn) Close() error                       { return c.ws.Close() }
+func (c *wsConn) LocalAddr() net.Addr                { return c.ws.LocalAddr() }
+func (c *wsConn) RemoteAddr() net.Addr               { return c.ws.RemoteAddr() }
+func (c *wsConn) SetDeadline(t time.Time) error      { return c.ws.UnderlyingConn().SetDeadline(t) }
+func (c *wsConn) SetReadDeadline(t time.Time) error  { return c.ws.SetReadDeadline(t) }
+func (c *wsConn) SetWriteDeadline(t time.Time) error { return c.ws.SetWriteDeadline(t) }
+
+// originAllowed checks r's Origin header against Options.WSOrigins. An
+// empty allow-list accepts any origin.
+func (s *Server) originAllowed(r *http.Request) bool {
+	if len(s.opts.WSOrigins) == 0 {
+		return true
+	}
+	origin := r.Header.Get("Origin")
+	for _, o := range s.opts.WSOrigins {
+		if o == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// wsHandler upgrades to a WebSocket and hands it to createClient.
+func (s *Server) wsHandler(w http.ResponseWriter, r *http.Request) {
+	upgrader := websocket.Upgrader{
+		CheckOrigin:       s.originAllowed,
+		EnableCompression: true, // permessage-deflate
+	}
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		s.log.Debugf("WebSocket upgrade failed: %v", err)
+		return
+	}
+
+	conn := newWSConn(ws)
+	ws.SetReadDeadline(time.Now().Add(2 * wsPingInterval))
+	s.createClient(conn)
+}
+
+// RegisterWSHandler wires the WebSocket upgrade endpoint into the HTTP
+// monitor mux.
+func (s *Server) RegisterWSHandler() {
+	if s.opts.WSPort != 0 {
+		return
+	}
+	http.HandleFunc(DefaultWSPath, s.wsHandler)
+}
+
+// AcceptWSLoop runs a dedicated accept loop for Options.WSPort.
+func (s *Server) AcceptWSLoop() {
+	if s.opts.WSPort == 0 {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(DefaultWSPath, s.wsHandler)
+
+	hp := fmt.Sprintf("%s:%d", s.opts.Host, s.opts.WSPort)
+	l, e := net.Listen("tcp", hp)
+	if e != nil {
+		s.log.Fatalf("Error listening on websocket port: %d - %v", s.opts.WSPort, e)
+		return
+	}
+	if s.opts.TLSConfig != nil {
+		l = tls.NewListener(l, s.opts.TLSConfig)
+	}
+
+	s.log.Infof("Listening for websocket connections on %s", hp)
+	s.log.Fatalf("%v", http.Serve(l, mux))
+}
+
+// wsKeepalive pings every WebSocket client on wsPingInterval; a missed
+// pong lets the deadline in newWSConn's pong handler expire the conn.
+// This is separate from setPingTimer's app-level NATS PING: that one
+// checks the NATS session is alive end-to-end, while this one is a
+// transport-level WS control frame that keeps intermediary proxies and
+// idle browser sockets from timing out the connection underneath it.
+func (s *Server) wsKeepalive() {
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !s.isRunning() {
+			return
+		}
+		s.mu.Lock()
+		clients := make([]*client, 0, len(s.clients))
+		for _, c := range s.clients {
+			clients = append(clients, c)
+		}
+		s.mu.Unlock()
+
+		for _, c := range clients {
+			if wc, ok := c.conn.(*wsConn); ok {
+				wc.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second))
+			}
+		}
+	}
+}
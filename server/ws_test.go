@@ -0,0 +1,39 @@
+// Copyright 2012-2013 Apcera Inc. All rights reserved.
+
+package server
+
+import "testing"
+
+// TestWsConnReadLeftoverBuffering exercises Read's leftover buffer
+// directly, without a real *websocket.Conn, since wsConn.Read only
+// touches c.ws on an empty leftover buffer.
+func TestWsConnReadLeftoverBuffering(t *testing.T) {
+	c := &wsConn{}
+	c.leftover.WriteString("hello world")
+
+	buf := make([]byte, 4)
+	n, err := c.Read(buf)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if string(buf[:n]) != "hell" {
+		t.Fatalf("Read() = %q, want %q", buf[:n], "hell")
+	}
+
+	n, err = c.Read(buf)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if string(buf[:n]) != "o wo" {
+		t.Fatalf("Read() = %q, want %q", buf[:n], "o wo")
+	}
+
+	rest := make([]byte, 16)
+	n, err = c.Read(rest)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if string(rest[:n]) != "rld" {
+		t.Fatalf("Read() = %q, want %q", rest[:n], "rld")
+	}
+}